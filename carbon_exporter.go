@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// carbonBufferSamples bounds how many samples we'll hold in memory while
+// the carbon receiver is unreachable. Once full, the oldest samples are
+// dropped to make room for new ones rather than growing without bound.
+const carbonBufferSamples = 10000
+
+var carbonUnitSuffix = regexp.MustCompile(`\[[^\]]*\]$`)
+
+// carbonMetricPath translates a `newrelic:"Component/..."` struct tag into
+// a carbon plaintext metric path, e.g.
+// "Component/Connections/Accepted[Connections/sec]" -> "<prefix>.connections.accepted".
+func carbonMetricPath(prefix, tag string) string {
+	tag = carbonUnitSuffix.ReplaceAllString(tag, "")
+	tag = strings.TrimPrefix(tag, "Component/")
+	tag = strings.ReplaceAll(tag, "/", ".")
+
+	return prefix + "." + strings.ToLower(tag)
+}
+
+type carbonSample struct {
+	path  string
+	value int64
+	ts    int64
+}
+
+// CarbonExporter pushes the same metrics every other exporter sees to a
+// Graphite carbon receiver over TCP using the plaintext protocol. It
+// reconnects on EOF and buffers samples in memory (dropping the oldest)
+// when the receiver can't be reached, so a short carbon outage doesn't
+// take the whole exporter down.
+type CarbonExporter struct {
+	ch     chan []Component
+	addr   string
+	prefix string
+	buffer []carbonSample
+	conn   net.Conn
+}
+
+func NewCarbonExporter(addr, prefix string) *CarbonExporter {
+	return &CarbonExporter{
+		ch:     make(chan []Component),
+		addr:   addr,
+		prefix: prefix,
+	}
+}
+
+func (e *CarbonExporter) Name() string              { return "carbon" }
+func (e *CarbonExporter) Channel() chan []Component { return e.ch }
+
+func (e *CarbonExporter) Run() {
+	for components := range e.ch {
+		now := time.Now().Unix()
+
+		for _, c := range components {
+			nrComponent := c.Harvest()
+			for tag, value := range nrComponent.Metrics {
+				e.enqueue(carbonSample{
+					path:  carbonMetricPath(e.prefix, tag),
+					value: value,
+					ts:    now,
+				})
+			}
+		}
+
+		e.flush()
+	}
+}
+
+// enqueue appends a sample to the buffer, dropping the oldest one if it's
+// grown past carbonBufferSamples.
+func (e *CarbonExporter) enqueue(sample carbonSample) {
+	e.buffer = append(e.buffer, sample)
+
+	if len(e.buffer) > carbonBufferSamples {
+		e.buffer = e.buffer[len(e.buffer)-carbonBufferSamples:]
+	}
+}
+
+// flush tries to drain the buffer to the carbon receiver, reconnecting if
+// needed. Anything that can't be sent (receiver down, write failed) stays
+// buffered for the next poll.
+func (e *CarbonExporter) flush() {
+	conn, err := e.connection()
+	if err != nil {
+		log.Warnf("Carbon receiver %s unreachable, buffering %d samples: %s", e.addr, len(e.buffer), err)
+		return
+	}
+
+	sent := 0
+	for _, sample := range e.buffer {
+		line := fmt.Sprintf("%s %d %d\n", sample.path, sample.value, sample.ts)
+
+		if _, err := conn.Write([]byte(line)); err != nil {
+			log.Warnf("Lost connection to carbon receiver, will reconnect: %s", err)
+			conn.Close()
+			e.conn = nil
+			break
+		}
+
+		sent++
+	}
+
+	e.buffer = e.buffer[sent:]
+}
+
+// connection returns the current connection to the carbon receiver,
+// dialing a new one if we don't have one (startup, or a previous write
+// hit EOF and closed it out).
+func (e *CarbonExporter) connection() (net.Conn, error) {
+	if e.conn != nil {
+		return e.conn, nil
+	}
+
+	conn, err := net.DialTimeout("tcp", e.addr, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	e.conn = conn
+	return conn, nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func Test_CarbonMetricPath(t *testing.T) {
+	cases := []struct {
+		tag  string
+		want string
+	}{
+		{"Component/Connections/Accepted[Connections/sec]", "nginx.connections.accepted"},
+		{"Component/SSL/Handshakes[Handshakes/sec]", "nginx.ssl.handshakes"},
+		{"Component/Requests/Total[Connections]", "nginx.requests.total"},
+	}
+
+	for _, c := range cases {
+		got := carbonMetricPath("nginx", c.tag)
+		if got != c.want {
+			t.Errorf("carbonMetricPath(%q) = %q, want %q", c.tag, got, c.want)
+		}
+	}
+}
+
+func Test_CarbonExporter_EnqueueEvictsOldest(t *testing.T) {
+	e := NewCarbonExporter("127.0.0.1:0", "nginx")
+
+	for i := 0; i < carbonBufferSamples+10; i++ {
+		e.enqueue(carbonSample{path: fmt.Sprintf("metric.%d", i), value: int64(i), ts: int64(i)})
+	}
+
+	if len(e.buffer) != carbonBufferSamples {
+		t.Fatalf("buffer len = %d, want %d", len(e.buffer), carbonBufferSamples)
+	}
+
+	// The 10 oldest samples should have been dropped to make room.
+	if e.buffer[0].value != 10 {
+		t.Errorf("buffer[0].value = %d, want 10 (oldest samples should be evicted)", e.buffer[0].value)
+	}
+	if last := e.buffer[len(e.buffer)-1].value; last != carbonBufferSamples+9 {
+		t.Errorf("buffer[last].value = %d, want %d", last, carbonBufferSamples+9)
+	}
+}
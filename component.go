@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// InstanceConfig describes a single Nginx instance to scrape and report
+// as its own New Relic component.
+type InstanceConfig struct {
+	Name     string `json:"name"`
+	Guid     string `json:"guid"`
+	StatsUrl string `json:"stats_url"`
+	Format   string `json:"format"`
+}
+
+// Component is implemented by anything that can be polled and harvested
+// into a New Relic component payload. Modeled after the harvest pattern in
+// newrelic_platform_go, so one agent process can report a whole fleet of
+// instances under a single upload.
+type Component interface {
+	Harvest() *NrComponent
+	SetDuration(seconds int)
+	Name() string
+	Guid() string
+}
+
+// ComponentState holds the per-instance counters needed to turn nginx's
+// running totals into the deltas New Relic expects. The SSL/zone/cache
+// fields are only ever populated for STATS_FORMAT=plus components.
+type ComponentState struct {
+	Accepted    int64
+	SumAccepted int64
+	Dropped     int64
+	Total       int64
+	Active      int64
+	Idle        int64
+	Current     int64
+
+	SSLHandshakes          int64
+	SumSSLHandshakes       int64
+	SSLHandshakesFailed    int64
+	SumSSLHandshakesFailed int64
+
+	Zones  map[string]*zoneCounterState
+	Caches map[string]*cacheCounterState
+}
+
+// NginxComponent polls a single nginx status endpoint and reports it as
+// one New Relic component. Format picks which wire format StatsUrl speaks
+// ("stub" or "plus"); see plus_status.go for the latter.
+type NginxComponent struct {
+	ComponentName string
+	ComponentGuid string
+	StatsUrl      string
+	Format        string
+	duration      int
+	state         ComponentState
+	lastUpstreams map[string]UpstreamReading
+}
+
+// NewNginxComponent builds a component from an instance config, defaulting
+// the guid to the agent's own guid and the format to the globally
+// configured STATS_FORMAT so single-instance setups keep reporting under
+// the name and format they always have.
+func NewNginxComponent(instance InstanceConfig) *NginxComponent {
+	guid := instance.Guid
+	if guid == "" {
+		guid = AgentGuid
+	}
+
+	format := instance.Format
+	if format == "" {
+		format = config.StatsFormat
+	}
+
+	return &NginxComponent{
+		ComponentName: instance.Name,
+		ComponentGuid: guid,
+		StatsUrl:      instance.StatsUrl,
+		Format:        format,
+	}
+}
+
+func (c *NginxComponent) Name() string { return c.ComponentName }
+func (c *NginxComponent) Guid() string { return c.ComponentGuid }
+
+func (c *NginxComponent) SetDuration(seconds int) { c.duration = seconds }
+
+// poll fetches this component's stats, using whichever wire format it's
+// configured for, and folds them into its state.
+func (c *NginxComponent) poll() error {
+	fetch := GetStats
+	if c.Format == "plus" {
+		fetch = GetPlusStats
+	}
+
+	start := time.Now()
+	metric, err := fetch(c.StatsUrl)
+	fetchLatency.Observe(time.Since(start))
+	if err != nil {
+		return err
+	}
+
+	c.processOne(metric)
+	c.processPlusExtras(metric)
+	return nil
+}
+
+// processOne transforms a stats reading into this component's counters.
+func (c *NginxComponent) processOne(metric *MetricReading) {
+	s := &c.state
+
+	// We don't want to report giant spikes on the graph on startup
+	if s.SumAccepted != 0 {
+		// Accepted is a counter... we need to subtract the total each time
+		s.Accepted = (metric.Accepts - s.SumAccepted) / PollSeconds // report rps not rpm
+	}
+	s.SumAccepted = metric.Accepts
+
+	s.Dropped = metric.Accepts - metric.Handled - s.Dropped
+	s.Active = metric.Connections
+	s.Idle = metric.Waiting
+	s.Total = s.Active + s.Idle
+	s.Current = metric.Reading + metric.Writing
+
+	log.Debugf(`
+		Component: %s
+		Accepted:  %d
+		Dropped:   %d
+		Total:     %d
+		Active:    %d
+		Idle:      %d
+		Current:   %d
+	`, c.ComponentName, s.Accepted, s.Dropped, s.Total, s.Active, s.Idle, s.Current,
+	)
+}
+
+// Harvest formats this component's current state as an NrComponent ready
+// to be folded into an upload batch.
+func (c *NginxComponent) Harvest() *NrComponent {
+	s := c.state
+
+	batch := NrMetric{
+		Accepted:            s.Accepted,
+		Dropped:             s.Dropped,
+		Total:               s.Total,
+		Active:              s.Active,
+		Idle:                s.Idle,
+		Current:             s.Current,
+		SummaryIdle:         s.Idle,
+		SummaryActive:       s.Active,
+		SSLHandshakes:       s.SSLHandshakes,
+		SSLHandshakesFailed: s.SSLHandshakesFailed,
+	}
+
+	metrics := marshalMetrics(batch)
+	for name, value := range c.plusExtrasMetrics() {
+		metrics[name] = value
+	}
+
+	return &NrComponent{
+		Guid:     c.ComponentGuid,
+		Duration: c.duration,
+		Name:     c.ComponentName,
+		Metrics:  metrics,
+	}
+}
+
+// parseInstances decodes the AGENT_INSTANCES config value into a slice of
+// instance configs. It accepts a JSON array; when unset, it falls back to
+// a single instance built from the legacy StatsUrl/NewRelicAppName fields
+// so existing single-instance deployments don't need to change anything.
+func parseInstances(raw string, fallback InstanceConfig) ([]InstanceConfig, error) {
+	if raw == "" {
+		return []InstanceConfig{fallback}, nil
+	}
+
+	var instances []InstanceConfig
+	if err := json.Unmarshal([]byte(raw), &instances); err != nil {
+		return nil, err
+	}
+
+	return instances, nil
+}
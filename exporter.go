@@ -0,0 +1,213 @@
+package main
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Exporter receives each poll's freshly-harvested components over its own
+// channel and is responsible for getting them to wherever they're meant to
+// go (New Relic, Prometheus, ...). Each exporter gets its own channel and
+// goroutine so a slow or failing sink can't block any of the others.
+type Exporter interface {
+	Name() string
+	Channel() chan []Component
+	Run()
+}
+
+// Drainable is implemented by exporters that may still have work in
+// flight after their channel is closed - an upload retrying in the
+// background, say. main() waits on these after closing every exporter's
+// channel, so a shutdown can't kill that work before it either finishes
+// or gets somewhere durable.
+type Drainable interface {
+	Wait()
+}
+
+// buildExporters turns the AGENT_EXPORTERS config list into the exporters
+// to wire up, skipping ones that are missing the config they need.
+func buildExporters(names []string) []Exporter {
+	exporters := make([]Exporter, 0, len(names))
+
+	for _, name := range names {
+		switch name {
+		case "newrelic":
+			if config.NewRelicLicenseKey == "" {
+				log.Warnf("No New Relic license key... skipping the newrelic exporter")
+				continue
+			}
+			exporters = append(exporters, NewNewRelicExporter(config.QueueDir))
+		case "prometheus":
+			exporters = append(exporters, NewPrometheusExporter(config.PrometheusAddr))
+		case "carbon":
+			if config.CarbonAddr == "" {
+				log.Warnf("No CARBON_ADDR configured... skipping the carbon exporter")
+				continue
+			}
+			exporters = append(exporters, NewCarbonExporter(config.CarbonAddr, carbonPrefix()))
+		default:
+			log.Warnf("Unknown exporter %q in AGENT_EXPORTERS, ignoring", name)
+		}
+	}
+
+	return exporters
+}
+
+// carbonPrefix returns the configured CARBON_PREFIX, defaulting to
+// "nginx.<hostname>" so metrics from different hosts don't collide.
+func carbonPrefix() string {
+	if config.CarbonPrefix != "" {
+		return config.CarbonPrefix
+	}
+
+	hostname, _ := os.Hostname()
+	return "nginx." + hostname
+}
+
+// fanOutToExporters hands the freshly-polled components to every enabled
+// exporter without letting a stalled one block the others.
+//
+// For NewRelicExporter, the in-flight count is bumped here, before the
+// channel send, rather than in Run() after the receive: a send on e.ch
+// only guarantees the receive has happened, not that any code the
+// receiving goroutine runs afterwards (like wg.Add(1)) has too. Bumping
+// it here instead means it happens-before this call returns, which is
+// itself sequenced before processStats returns and main() ever gets to
+// close e.ch and call Wait() - so Wait() can no longer race ahead of a
+// batch that was just handed off.
+func fanOutToExporters(exporters []Exporter, components []Component) {
+	for _, exp := range exporters {
+		nr, tracked := exp.(*NewRelicExporter)
+		if tracked {
+			nr.wg.Add(1)
+		}
+
+		select {
+		case exp.Channel() <- components:
+			// great!
+		case <-time.After(1 * time.Second):
+			log.Warnf("Exporter %s isn't keeping up. Dropping this poll for it", exp.Name())
+			if tracked {
+				nr.wg.Done()
+			}
+		}
+	}
+}
+
+const (
+	uploadMaxRetries   = 5
+	uploadRetryBackoff = 1 * time.Second
+)
+
+// NewRelicExporter batches every component's harvested metrics into a
+// single upload, same as the agent has always done, but now retries
+// transient failures with exponential backoff and falls back to an
+// on-disk queue if New Relic stays unreachable.
+type NewRelicExporter struct {
+	ch    chan []Component
+	queue *DiskQueue
+	wg    sync.WaitGroup
+}
+
+// activeQueue points at the on-disk retry queue in use, if any, so
+// SelfComponent can report its depth without the exporter having to know
+// anything about self-monitoring.
+var activeQueue *DiskQueue
+
+// NewNewRelicExporter builds the exporter and, if queueDir is set, replays
+// any uploads left over from a previous run before the poll loop starts
+// producing new ones.
+func NewNewRelicExporter(queueDir string) *NewRelicExporter {
+	exp := &NewRelicExporter{ch: make(chan []Component)}
+
+	if queueDir != "" {
+		exp.queue = NewDiskQueue(queueDir)
+		activeQueue = exp.queue
+		if err := exp.queue.Replay(uploadOne); err != nil {
+			log.Errorf("Failed to replay queued New Relic uploads: %s", err)
+		}
+	}
+
+	return exp
+}
+
+func (e *NewRelicExporter) Name() string              { return "newrelic" }
+func (e *NewRelicExporter) Channel() chan []Component { return e.ch }
+
+// Run hands each batch off to send in its own goroutine rather than
+// calling it inline, so a slow retry (send can block for up to ~31s
+// across its backoff schedule) never stops Run from accepting the next
+// poll's batch off the channel - otherwise fanOutToExporters would give
+// up on us after a 1s rendezvous and silently drop that cycle's data.
+// The in-flight count is tracked by fanOutToExporters before the batch
+// is even sent here, not by this function - see its comment.
+func (e *NewRelicExporter) Run() {
+	for components := range e.ch {
+		nrComponents := make([]*NrComponent, 0, len(components))
+		for _, c := range components {
+			nrComponents = append(nrComponents, c.Harvest())
+		}
+
+		upload := NewNrUpload(nrComponents)
+		go func() {
+			defer e.wg.Done()
+			e.send(upload)
+		}()
+	}
+}
+
+// Wait blocks until every in-flight send has either succeeded or been
+// queued to disk. main() calls this after closing e.ch so a shutdown
+// can't kill a retry that's still in progress.
+func (e *NewRelicExporter) Wait() {
+	e.wg.Wait()
+}
+
+// send uploads a batch, retrying transient failures with exponential
+// backoff (honoring Retry-After when New Relic sends one). Once it's
+// retried enough that holding the batch in memory risks losing it, the
+// batch goes to the on-disk queue instead.
+func (e *NewRelicExporter) send(upload *NrUpload) {
+	backoff := uploadRetryBackoff
+
+	for attempt := 1; attempt <= uploadMaxRetries; attempt++ {
+		err := uploadOne(upload)
+		if err == nil {
+			return
+		}
+
+		retryErr, ok := err.(*retryableUploadError)
+		if !ok {
+			log.Errorf("Failed to upload to New Relic: %s", err)
+			e.enqueue(upload)
+			return
+		}
+
+		wait := backoff
+		if retryErr.retryAfter > 0 {
+			wait = retryErr.retryAfter
+		}
+
+		log.Warnf("New Relic upload failed (attempt %d/%d): %s. Retrying in %s",
+			attempt, uploadMaxRetries, retryErr, wait)
+		time.Sleep(wait)
+		backoff *= 2
+	}
+
+	log.Errorf("Giving up on New Relic upload after %d attempts, queuing to disk", uploadMaxRetries)
+	e.enqueue(upload)
+}
+
+func (e *NewRelicExporter) enqueue(upload *NrUpload) {
+	if e.queue == nil {
+		log.Warn("No AGENT_QUEUE_DIR configured, dropping failed upload")
+		return
+	}
+
+	if err := e.queue.Enqueue(upload); err != nil {
+		log.Errorf("Failed to queue upload to disk: %s", err)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Test_NewRelicExporter_WaitDrainsInFlightSend exercises the shutdown-drain
+// path: main() closes each exporter's channel and then calls Wait() on it,
+// and that must not return while a send is still in flight - otherwise a
+// SIGTERM during a slow upload would let the process exit before the data
+// either lands or gets queued to disk.
+//
+// It goes through fanOutToExporters, the real producer path, rather than
+// sending on exp.Channel() directly, and checks immediately after close()
+// with no sleep to give the scheduler a grace period - an earlier version
+// of this test slept 200ms before asserting Wait hadn't returned yet, which
+// gave Run()'s goroutine plenty of time to register the in-flight send
+// regardless of whether the tracking was actually ordered correctly. It
+// also loops several times so a rare scheduling order has more chances to
+// turn into a caught failure; run with -race for the strongest signal.
+func Test_NewRelicExporter_WaitDrainsInFlightSend(t *testing.T) {
+	origURL, origKey := config.NewRelicApiUrl, config.NewRelicLicenseKey
+	defer func() {
+		config.NewRelicApiUrl, config.NewRelicLicenseKey = origURL, origKey
+	}()
+	config.NewRelicLicenseKey = "test"
+
+	for i := 0; i < 50; i++ {
+		release := make(chan struct{})
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-release
+			w.WriteHeader(http.StatusOK)
+		}))
+		config.NewRelicApiUrl = server.URL
+
+		exp := NewNewRelicExporter("")
+		go exp.Run()
+
+		fanOutToExporters([]Exporter{exp}, nil)
+		close(exp.Channel())
+
+		done := make(chan struct{})
+		go func() {
+			exp.Wait()
+			close(done)
+		}()
+
+		select {
+		case <-done:
+			t.Fatalf("iteration %d: Wait returned before the in-flight send finished", i)
+		default:
+			// Still draining, as expected.
+		}
+
+		close(release)
+
+		select {
+		case <-done:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("iteration %d: Wait did not return after the send completed", i)
+		}
+
+		server.Close()
+	}
+}
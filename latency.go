@@ -0,0 +1,79 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// latencyBuckets are the upper bounds used to bucket request durations,
+// matching the bucketing go-carbon's own bucketRequestTimes uses for its
+// self-instrumentation. A sample that doesn't fit under the last bound
+// falls into the implicit ">=5s" overflow bucket.
+var latencyBuckets = [6]time.Duration{
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	1 * time.Second,
+	5 * time.Second,
+}
+
+// latencyHistogram tracks how long a recurring operation (an nginx fetch,
+// a New Relic upload) takes. It only keeps bucket counts and a running
+// sum/count rather than every sample, since all we report is a mean per
+// harvest. A sample landing in the overflow bucket is logged right away,
+// since by the time it'd show up on a dashboard the request is long over.
+type latencyHistogram struct {
+	name string
+
+	mu      sync.Mutex
+	buckets [len(latencyBuckets) + 1]int64
+	sum     time.Duration
+	count   int64
+}
+
+func newLatencyHistogram(name string) *latencyHistogram {
+	return &latencyHistogram{name: name}
+}
+
+// Observe records one sample.
+func (h *latencyHistogram) Observe(d time.Duration) {
+	bucket := len(latencyBuckets)
+	for i, upper := range latencyBuckets {
+		if d < upper {
+			bucket = i
+			break
+		}
+	}
+
+	h.mu.Lock()
+	h.buckets[bucket]++
+	h.sum += d
+	h.count++
+	h.mu.Unlock()
+
+	if bucket == len(latencyBuckets) {
+		log.Warnf("%s took %s (>=5s), which is unusually slow", h.name, d)
+	}
+}
+
+// HarvestMeanMs returns the mean duration in milliseconds observed since
+// the last harvest, then resets the histogram so the next harvest only
+// covers samples from the next poll interval.
+func (h *latencyHistogram) HarvestMeanMs() int64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var meanMs int64
+	if h.count > 0 {
+		meanMs = (int64(h.sum) / int64(time.Millisecond)) / h.count
+	}
+
+	h.buckets = [len(latencyBuckets) + 1]int64{}
+	h.sum = 0
+	h.count = 0
+
+	return meanMs
+}
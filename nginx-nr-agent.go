@@ -1,8 +1,8 @@
 package main
 
 // Go replacement for the nginx New Relic plugin. No Python runtime required.
-// Only reports on a single instance of Nginx, and takes configuration from
-// environment variables.
+// Takes configuration from environment variables, and can report on a fleet
+// of Nginx instances as distinct New Relic components from a single process.
 
 import (
 	"bytes"
@@ -14,6 +14,7 @@ import (
 	"reflect"
 	"regexp"
 	"strconv"
+	"sync/atomic"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
@@ -26,7 +27,7 @@ const (
 	AgentVersion     = "2.0.1"
 	PollSeconds      = 60
 	PollInterval     = PollSeconds * time.Second // How often we're polling. New Relic expects 1 minute
-	ErrorBackoffTime = 10 * time.Second // How long to back off on errored stats fetch
+	ErrorBackoffTime = 10 * time.Second          // How long to back off on errored stats fetch
 )
 
 var (
@@ -40,25 +41,27 @@ var (
 			"\\s+Waiting:\\s+(?P<waiting>\\d+)",
 	)
 
-	accepted    int64
-	sumAccepted int64
-	dropped     int64
-	total       int64
-	active      int64
-	idle        int64
-	current     int64
-
 	config Config
 )
 
 type Config struct {
-	NewRelicAppName    string `split_words:"true"`
-	NewRelicApiUrl     string `split_words:"true" default:"https://platform-api.newrelic.com/platform/v1/metrics"`
-	NewRelicLicenseKey string `split_words:"true"`
-	StatsUrl           string `split_words:"true" default:"http://localhost:8000/status"`
-	Debug              bool   `envconfig:"DEBUG" default:"false"`
+	NewRelicAppName    string   `split_words:"true"`
+	NewRelicApiUrl     string   `split_words:"true" default:"https://platform-api.newrelic.com/platform/v1/metrics"`
+	NewRelicLicenseKey string   `split_words:"true"`
+	StatsUrl           string   `split_words:"true" default:"http://localhost:8000/status"`
+	StatsFormat        string   `split_words:"true" default:"stub"`
+	Instances          string   `split_words:"true"`
+	Exporters          []string `split_words:"true" default:"newrelic"`
+	PrometheusAddr     string   `split_words:"true" default:":9113"`
+	CarbonAddr         string   `split_words:"true"`
+	CarbonPrefix       string   `split_words:"true"`
+	QueueDir           string   `split_words:"true"`
+	Debug              bool     `envconfig:"DEBUG" default:"false"`
 }
 
+// MetricReading is a single poll's worth of data. Connections/Accepts/...
+// come from every format; ServerZones/Upstreams/SSL/Caches are only
+// populated when fetched via the Nginx Plus JSON API (STATS_FORMAT=plus).
 type MetricReading struct {
 	Connections int64
 	Accepts     int64
@@ -67,18 +70,47 @@ type MetricReading struct {
 	Reading     int64
 	Writing     int64
 	Waiting     int64
+
+	ServerZones map[string]ZoneReading
+	Upstreams   map[string]UpstreamReading
+	Caches      map[string]CacheReading
+
+	SSLHandshakes       int64
+	SSLHandshakesFailed int64
+}
+
+// ZoneReading is the request/response counters for one Nginx Plus server
+// zone.
+type ZoneReading struct {
+	Requests     int64
+	Responses4xx int64
+	Responses5xx int64
+}
+
+// UpstreamReading is the health of each peer in one Nginx Plus upstream
+// group, keyed by "host:port".
+type UpstreamReading struct {
+	Peers map[string]string
+}
+
+// CacheReading is the hit/miss counters for one Nginx Plus cache zone.
+type CacheReading struct {
+	Hits   int64
+	Misses int64
 }
 
 // The data we'll report to New Relic
 type NrMetric struct {
-	Accepted int64 `newrelic:"Component/Connections/Accepted[Connections/sec]"`
-	Dropped  int64 `newrelic:"Component/Connections/Dropped[Connections/sec]"`
-	Total    int64 `newrelic:"Component/Requests/Total[Connections]"`
-	Active   int64 `newrelic:"Component/Connections/Active[Connections]"`
-	Idle     int64 `newrelic:"Component/Connections/Idle[Connections]"`
-	Current  int64 `newrelic:"Component/Requests/Current[Requests]"`
-	SummaryIdle   int64   `newrelic:"Component/ConnSummary/Idle[Connections]"`
-	SummaryActive int64   `newrelic:"Component/ConnSummary/Active[Connections]"`
+	Accepted            int64 `newrelic:"Component/Connections/Accepted[Connections/sec]"`
+	Dropped             int64 `newrelic:"Component/Connections/Dropped[Connections/sec]"`
+	Total               int64 `newrelic:"Component/Requests/Total[Connections]"`
+	Active              int64 `newrelic:"Component/Connections/Active[Connections]"`
+	Idle                int64 `newrelic:"Component/Connections/Idle[Connections]"`
+	Current             int64 `newrelic:"Component/Requests/Current[Requests]"`
+	SummaryIdle         int64 `newrelic:"Component/ConnSummary/Idle[Connections]"`
+	SummaryActive       int64 `newrelic:"Component/ConnSummary/Active[Connections]"`
+	SSLHandshakes       int64 `newrelic:"Component/SSL/Handshakes[Handshakes/sec]"`
+	SSLHandshakesFailed int64 `newrelic:"Component/SSL/HandshakesFailed[Handshakes/sec]"`
 }
 
 type NrUpload struct {
@@ -93,15 +125,6 @@ type NrComponent struct {
 	Metrics  map[string]int64 `json:"metrics"`
 }
 
-func NewNrComponent(metrics map[string]int64) *NrComponent {
-	return &NrComponent{
-		Guid:     AgentGuid,
-		Duration: (int)(PollInterval / time.Second),
-		Name:     config.NewRelicAppName,
-		Metrics:  metrics,
-	}
-}
-
 func NewNrUpload(components []*NrComponent) *NrUpload {
 	hostname, _ := os.Hostname()
 
@@ -115,6 +138,21 @@ func NewNrUpload(components []*NrComponent) *NrUpload {
 	}
 }
 
+// marshalMetrics uses reflection to read the newrelic struct tags off a
+// metrics batch (NrMetric, SelfMetric, ...)... slow, but not high
+// throughput.
+func marshalMetrics(batch interface{}) map[string]int64 {
+	st := reflect.TypeOf(batch)
+	item := reflect.ValueOf(batch)
+	metrics := make(map[string]int64, st.NumField())
+
+	for i := 0; i < st.NumField(); i++ {
+		metrics[st.Field(i).Tag.Get("newrelic")] = item.Field(i).Int()
+	}
+
+	return metrics
+}
+
 // Connect up to nginx and fetch the stub status output
 func GetStats(url string) (*MetricReading, error) {
 	client := &http.Client{
@@ -154,76 +192,16 @@ func GetStats(url string) (*MetricReading, error) {
 	return &metric, nil
 }
 
-// Transform the reading from Nginx into the metric values, and update
-func processOne(metric *MetricReading) {
-	// We don't want to report giant spikes on the graph on startup
-	if sumAccepted != 0 {
-		// Accepted is a counter... we need to subtract the total each time
-		accepted = (metric.Accepts - sumAccepted) / PollSeconds // report rps not rpm
-	}
-	sumAccepted = metric.Accepts
-
-	dropped = metric.Accepts - metric.Handled - dropped
-	active = metric.Connections
-	idle = metric.Waiting
-	total = active + idle
-	current = metric.Reading + metric.Writing
-
-	log.Debugf(`
-		Accepted: %d
-		Dropped:  %d
-		Total:    %d
-		Active:   %d
-		Idle:     %d
-		Current:  %d
-	`, accepted, dropped, total, active, idle, current,
-	)
-}
-
-// Format an NrMetric and put it into the upload channel
-func notifyNewRelic(nrChan chan *NrMetric) {
-	batch := NrMetric{
-		Accepted: accepted,
-		Dropped:  dropped,
-		Total:    total,
-		Active:   active,
-		Idle:     idle,
-		Current:  current,
-		SummaryIdle:   idle,
-		SummaryActive: active,
-	}
-
-	select {
-	case nrChan <- &batch:
-		// great!
-	case <-time.After(1 * time.Second):
-		log.Warn("Nothing is consuming New Relic reporting events. Giving up reporting")
-	}
-}
-
-// Runs in the background, uploading things as they arrive in the channel
-func processUploads(nrChan chan *NrMetric) {
-	// Uses reflection to read the struct tags... slow, but not high throughput
-	for batch := range nrChan {
-		st := reflect.TypeOf(*batch)
-		item := reflect.ValueOf(*batch)
-		metrics := make(map[string]int64, st.NumField())
-
-		for i := 0; i < st.NumField(); i++ {
-			metrics[st.Field(i).Tag.Get("newrelic")] = item.Field(i).Int()
-		}
-
-		upload := NewNrUpload([]*NrComponent{NewNrComponent(metrics)})
-
-		err := uploadOne(upload)
+// Handle uploading one metric batch
+func uploadOne(upload *NrUpload) (err error) {
+	start := time.Now()
+	defer func() {
+		uploadLatency.Observe(time.Since(start))
 		if err != nil {
-			log.Errorf("Failed to upload to New Relic: %s", err)
+			atomic.AddInt64(&uploadErrorCount, 1)
 		}
-	}
-}
+	}()
 
-// Handle uploading one metric batch
-func uploadOne(upload *NrUpload) error {
 	log.Debugf("Uploading to New Relic")
 	client := &http.Client{
 		Timeout: 15 * time.Second,
@@ -260,13 +238,17 @@ func uploadOne(upload *NrUpload) error {
 
 	if response.StatusCode > 299 || response.StatusCode < 200 {
 		body, _ := ioutil.ReadAll(response.Body)
-
-		return fmt.Errorf("Got invalid response from New Relic (%d): %s",
+		uploadErr := fmt.Errorf("Got invalid response from New Relic (%d): %s",
 			response.StatusCode, string(body))
-	}
 
-	if err != nil {
-		return err
+		if response.StatusCode == 429 || response.StatusCode == 503 {
+			return &retryableUploadError{
+				err:        uploadErr,
+				retryAfter: parseRetryAfter(response.Header.Get("Retry-After")),
+			}
+		}
+
+		return uploadErr
 	}
 
 	log.Debugf("Successful upload to New Relic")
@@ -274,22 +256,72 @@ func uploadOne(upload *NrUpload) error {
 	return nil
 }
 
-// Immediately, and on a timed loop, update the metrics.
-func processStats(quit chan struct{}, nrChan chan *NrMetric) {
+// retryableUploadError marks an uploadOne failure as transient (New Relic
+// responded 429/503) along with how long it asked us to wait before the
+// next attempt.
+type retryableUploadError struct {
+	err        error
+	retryAfter time.Duration
+}
+
+func (e *retryableUploadError) Error() string { return e.err.Error() }
+
+// parseRetryAfter reads a Retry-After header value (seconds only - New
+// Relic doesn't send the HTTP-date form) and falls back to a sane default
+// when it's missing or malformed.
+func parseRetryAfter(value string) time.Duration {
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds <= 0 {
+		return uploadRetryBackoff
+	}
+
+	return time.Duration(seconds) * time.Second
+}
+
+// pollOnce fetches fresh stats for every component. When honorShutdown is
+// true it skips the rest of the cycle as soon as a shutdown has been
+// requested, so a regular tick doesn't keep fetching components we're
+// about to stop reporting anyway. The final flush on the way out must
+// pass false - it's the one poll we've promised will actually happen
+// before the process exits, so it has to fetch fresh data even though
+// sigterm is already set by the time it runs.
+func pollOnce(components []Component, honorShutdown bool) {
+	for _, c := range components {
+		if honorShutdown && sigterm.IsSet() {
+			return
+		}
+
+		switch comp := c.(type) {
+		case *NginxComponent:
+			log.Debugf("Connecting to %s to fetch stats", comp.Name())
+			if err := comp.poll(); err != nil {
+				log.Errorf("Unable to fetch stats from %s: %s", comp.Name(), err)
+				time.Sleep(ErrorBackoffTime)
+			}
+		case *SelfComponent:
+			comp.refresh()
+		}
+	}
+}
+
+// Immediately, and on a timed loop, poll every registered component and
+// fan the results out to every enabled exporter. On a quit signal it does
+// one last poll and flush before returning, so a shutdown doesn't throw
+// away the most recent data.
+func processStats(components []Component, exporters []Exporter, quit chan struct{}) {
+	for _, c := range components {
+		c.SetDuration(int(PollInterval / time.Second))
+	}
+
 	for {
 		select {
 		case <-time.After(PollInterval):
-			log.Debug("Connecting to Nginx to fetch stats")
-			metric, err := GetStats(config.StatsUrl)
-			if err != nil {
-				log.Errorf("Unable to fetch stats from nginx: %s", err)
-				time.Sleep(ErrorBackoffTime)
-				continue
-			}
-			processOne(metric)
-			notifyNewRelic(nrChan)
+			pollOnce(components, true)
+			fanOutToExporters(exporters, components)
 		case <-quit:
-			log.Warn("Received quit signal, shutting down")
+			log.Warn("Received quit signal, flushing final poll before shutdown")
+			pollOnce(components, false)
+			fanOutToExporters(exporters, components)
 			return
 		}
 	}
@@ -305,16 +337,45 @@ func main() {
 		log.SetLevel(log.InfoLevel)
 	}
 
-	nrChan := make(chan *NrMetric)
+	instances, err := parseInstances(config.Instances, InstanceConfig{
+		Name:     config.NewRelicAppName,
+		StatsUrl: config.StatsUrl,
+	})
+	if err != nil {
+		log.Fatalf("Unable to parse AGENT_INSTANCES: %s", err)
+	}
+
+	components := make([]Component, 0, len(instances)+1)
+	for _, instance := range instances {
+		components = append(components, NewNginxComponent(instance))
+	}
+	components = append(components, NewSelfComponent())
+
+	exporters := buildExporters(config.Exporters)
+	for _, exp := range exporters {
+		go exp.Run()
+	}
+
 	quitChan := make(chan struct{})
+	statsDone := make(chan struct{})
 
-	go processStats(quitChan, nrChan)
+	go func() {
+		processStats(components, exporters, quitChan)
+		close(statsDone)
+	}()
 
-	if config.NewRelicLicenseKey == "" {
-		log.Warnf("No New Relic license key... skipping stats reporting")
-	} else {
-		go processUploads(nrChan)
+	waitForShutdown(quitChan)
+	<-statsDone
+
+	for _, exp := range exporters {
+		close(exp.Channel())
+	}
+
+	for _, exp := range exporters {
+		if drainable, ok := exp.(Drainable); ok {
+			drainable.Wait()
+		}
 	}
 
-	select {}
+	log.Warn("Shutdown complete")
 }
@@ -6,7 +6,7 @@ import (
 	httpmock "gopkg.in/jarcoal/httpmock.v1"
 )
 
-func NginxStatusReponseString() {
+func NginxStatusReponseString() string {
 	return `Active connections: 2
 server accepts handled requests
  31 30 42
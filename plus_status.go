@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// plusStatusReading is the subset of the Nginx Plus `/api/<n>/` (or the
+// legacy `/status`) JSON status document that we care about.
+type plusStatusReading struct {
+	Connections struct {
+		Accepted int64 `json:"accepted"`
+		Dropped  int64 `json:"dropped"`
+		Active   int64 `json:"active"`
+		Idle     int64 `json:"idle"`
+	} `json:"connections"`
+	Requests struct {
+		Total int64 `json:"total"`
+	} `json:"requests"`
+	ServerZones map[string]struct {
+		Requests  int64 `json:"requests"`
+		Responses struct {
+			Responses4xx int64 `json:"4xx"`
+			Responses5xx int64 `json:"5xx"`
+		} `json:"responses"`
+	} `json:"server_zones"`
+	Upstreams map[string]struct {
+		Peers []struct {
+			Server string `json:"server"`
+			State  string `json:"state"`
+		} `json:"peers"`
+	} `json:"upstreams"`
+	SSL struct {
+		Handshakes       int64 `json:"handshakes"`
+		HandshakesFailed int64 `json:"handshakes_failed"`
+	} `json:"ssl"`
+	Caches map[string]struct {
+		Hit struct {
+			Responses int64 `json:"responses"`
+		} `json:"hit"`
+		Miss struct {
+			Responses int64 `json:"responses"`
+		} `json:"miss"`
+	} `json:"caches"`
+}
+
+// GetPlusStats fetches and parses the Nginx Plus JSON status API, which
+// carries a lot more detail than the stub_status plaintext format: per
+// server-zone request/response breakdowns, upstream peer health, SSL
+// handshake counters, and cache hit/miss counters.
+func GetPlusStats(url string) (*MetricReading, error) {
+	client := &http.Client{
+		Timeout: 7 * time.Second,
+	}
+	response, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var status plusStatusReading
+	if err := json.Unmarshal(body, &status); err != nil {
+		return nil, err
+	}
+
+	metric := &MetricReading{
+		Connections: status.Connections.Active,
+		Accepts:     status.Connections.Accepted,
+		Handled:     status.Connections.Accepted - status.Connections.Dropped,
+		Requests:    status.Requests.Total,
+		Waiting:     status.Connections.Idle,
+
+		ServerZones:         make(map[string]ZoneReading, len(status.ServerZones)),
+		Upstreams:           make(map[string]UpstreamReading, len(status.Upstreams)),
+		Caches:              make(map[string]CacheReading, len(status.Caches)),
+		SSLHandshakes:       status.SSL.Handshakes,
+		SSLHandshakesFailed: status.SSL.HandshakesFailed,
+	}
+
+	for name, zone := range status.ServerZones {
+		metric.ServerZones[name] = ZoneReading{
+			Requests:     zone.Requests,
+			Responses4xx: zone.Responses.Responses4xx,
+			Responses5xx: zone.Responses.Responses5xx,
+		}
+	}
+
+	for name, upstream := range status.Upstreams {
+		peers := make(map[string]string, len(upstream.Peers))
+		for _, peer := range upstream.Peers {
+			peers[peer.Server] = peer.State
+		}
+		metric.Upstreams[name] = UpstreamReading{Peers: peers}
+	}
+
+	for name, cache := range status.Caches {
+		metric.Caches[name] = CacheReading{
+			Hits:   cache.Hit.Responses,
+			Misses: cache.Miss.Responses,
+		}
+	}
+
+	return metric, nil
+}
+
+// zoneCounterState tracks the running totals for one server zone so its
+// request/error counts can be differenced across polls, the same way
+// Accepts is today.
+type zoneCounterState struct {
+	Requests        int64
+	SumRequests     int64
+	Responses4xx    int64
+	SumResponses4xx int64
+	Responses5xx    int64
+	SumResponses5xx int64
+}
+
+// cacheCounterState tracks the running totals for one cache zone.
+type cacheCounterState struct {
+	Hits      int64
+	SumHits   int64
+	Misses    int64
+	SumMisses int64
+}
+
+// upstreamPeerState maps Nginx Plus peer states to a small numeric gauge,
+// since New Relic metrics are numbers rather than strings.
+var upstreamPeerState = map[string]int64{
+	"up":        0,
+	"down":      1,
+	"unavail":   2,
+	"checking":  3,
+	"unhealthy": 4,
+}
+
+// processPlusExtras folds the Nginx Plus-only fields of a reading (server
+// zones, caches, SSL handshakes) into this component's state. It's a
+// no-op for stub_status readings, which never populate these fields.
+func (c *NginxComponent) processPlusExtras(metric *MetricReading) {
+	s := &c.state
+
+	if s.SumSSLHandshakes != 0 {
+		s.SSLHandshakes = (metric.SSLHandshakes - s.SumSSLHandshakes) / PollSeconds
+	}
+	s.SumSSLHandshakes = metric.SSLHandshakes
+
+	if s.SumSSLHandshakesFailed != 0 {
+		s.SSLHandshakesFailed = (metric.SSLHandshakesFailed - s.SumSSLHandshakesFailed) / PollSeconds
+	}
+	s.SumSSLHandshakesFailed = metric.SSLHandshakesFailed
+
+	if len(metric.ServerZones) > 0 && s.Zones == nil {
+		s.Zones = make(map[string]*zoneCounterState, len(metric.ServerZones))
+	}
+	for name, zone := range metric.ServerZones {
+		zs, ok := s.Zones[name]
+		if !ok {
+			zs = &zoneCounterState{}
+			s.Zones[name] = zs
+		}
+
+		if zs.SumRequests != 0 {
+			zs.Requests = (zone.Requests - zs.SumRequests) / PollSeconds
+		}
+		zs.SumRequests = zone.Requests
+
+		if zs.SumResponses4xx != 0 {
+			zs.Responses4xx = (zone.Responses4xx - zs.SumResponses4xx) / PollSeconds
+		}
+		zs.SumResponses4xx = zone.Responses4xx
+
+		if zs.SumResponses5xx != 0 {
+			zs.Responses5xx = (zone.Responses5xx - zs.SumResponses5xx) / PollSeconds
+		}
+		zs.SumResponses5xx = zone.Responses5xx
+	}
+
+	if len(metric.Caches) > 0 && s.Caches == nil {
+		s.Caches = make(map[string]*cacheCounterState, len(metric.Caches))
+	}
+	for name, cache := range metric.Caches {
+		cs, ok := s.Caches[name]
+		if !ok {
+			cs = &cacheCounterState{}
+			s.Caches[name] = cs
+		}
+
+		if cs.SumHits != 0 {
+			cs.Hits = (cache.Hits - cs.SumHits) / PollSeconds
+		}
+		cs.SumHits = cache.Hits
+
+		if cs.SumMisses != 0 {
+			cs.Misses = (cache.Misses - cs.SumMisses) / PollSeconds
+		}
+		cs.SumMisses = cache.Misses
+	}
+
+	c.lastUpstreams = metric.Upstreams
+}
+
+// plusExtrasMetrics builds the dynamically-named New Relic metric entries
+// for server zones, upstream peers and caches, which can't be static
+// NrMetric struct fields because their names vary per nginx config.
+func (c *NginxComponent) plusExtrasMetrics() map[string]int64 {
+	s := &c.state
+	metrics := make(map[string]int64)
+
+	for name, zs := range s.Zones {
+		metrics["Component/ServerZones/"+name+"/Requests[Requests/sec]"] = zs.Requests
+		metrics["Component/ServerZones/"+name+"/Responses4xx[Errors/sec]"] = zs.Responses4xx
+		metrics["Component/ServerZones/"+name+"/Responses5xx[Errors/sec]"] = zs.Responses5xx
+	}
+
+	for name, cs := range s.Caches {
+		metrics["Component/Cache/"+name+"/Hits[Hits/sec]"] = cs.Hits
+		metrics["Component/Cache/"+name+"/Misses[Misses/sec]"] = cs.Misses
+	}
+
+	for upstreamName, upstream := range c.lastUpstreams {
+		for peer, state := range upstream.Peers {
+			value, ok := upstreamPeerState[state]
+			if !ok {
+				value = -1
+			}
+			metrics["Component/Upstreams/"+upstreamName+"/"+sanitizeMetricName(peer)+"/State[State]"] = value
+		}
+	}
+
+	return metrics
+}
+
+// sanitizeMetricName strips characters that don't belong in a New Relic
+// metric path segment, such as the ':' in a "host:port" peer address.
+func sanitizeMetricName(name string) string {
+	out := make([]rune, 0, len(name))
+	for _, r := range name {
+		if r == ':' {
+			out = append(out, '_')
+			continue
+		}
+		out = append(out, r)
+	}
+	return string(out)
+}
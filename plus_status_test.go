@@ -0,0 +1,162 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const plusStatusFixture = `{
+  "connections": {"accepted": 100, "dropped": 2, "active": 5, "idle": 3},
+  "requests": {"total": 250},
+  "server_zones": {
+    "api": {"requests": 80, "responses": {"4xx": 1, "5xx": 0}}
+  },
+  "upstreams": {
+    "backend": {"peers": [{"server": "10.0.0.1:80", "state": "up"}, {"server": "10.0.0.2:80", "state": "down"}]}
+  },
+  "ssl": {"handshakes": 20, "handshakes_failed": 1},
+  "caches": {
+    "static": {"hit": {"responses": 40}, "miss": {"responses": 10}}
+  }
+}`
+
+func Test_GetPlusStats(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(plusStatusFixture))
+	}))
+	defer server.Close()
+
+	metric, err := GetPlusStats(server.URL)
+	if err != nil {
+		t.Fatalf("GetPlusStats: %s", err)
+	}
+
+	if metric.Connections != 5 {
+		t.Errorf("Connections = %d, want 5", metric.Connections)
+	}
+	if metric.Accepts != 100 {
+		t.Errorf("Accepts = %d, want 100", metric.Accepts)
+	}
+	if metric.Handled != 98 {
+		t.Errorf("Handled = %d, want 98 (accepted - dropped)", metric.Handled)
+	}
+	if metric.Requests != 250 {
+		t.Errorf("Requests = %d, want 250", metric.Requests)
+	}
+	if metric.Waiting != 3 {
+		t.Errorf("Waiting = %d, want 3", metric.Waiting)
+	}
+	if metric.SSLHandshakes != 20 || metric.SSLHandshakesFailed != 1 {
+		t.Errorf("SSL handshakes = %d/%d, want 20/1", metric.SSLHandshakes, metric.SSLHandshakesFailed)
+	}
+
+	zone, ok := metric.ServerZones["api"]
+	if !ok {
+		t.Fatal("missing server zone \"api\"")
+	}
+	if zone.Requests != 80 || zone.Responses4xx != 1 || zone.Responses5xx != 0 {
+		t.Errorf("zone \"api\" = %+v, want {80 1 0}", zone)
+	}
+
+	upstream, ok := metric.Upstreams["backend"]
+	if !ok {
+		t.Fatal("missing upstream \"backend\"")
+	}
+	if upstream.Peers["10.0.0.1:80"] != "up" || upstream.Peers["10.0.0.2:80"] != "down" {
+		t.Errorf("upstream peers = %+v, want up/down", upstream.Peers)
+	}
+
+	cache, ok := metric.Caches["static"]
+	if !ok {
+		t.Fatal("missing cache \"static\"")
+	}
+	if cache.Hits != 40 || cache.Misses != 10 {
+		t.Errorf("cache \"static\" = %+v, want {40 10}", cache)
+	}
+}
+
+func Test_ProcessPlusExtras_DeltaMath(t *testing.T) {
+	c := &NginxComponent{ComponentName: "test"}
+
+	first := &MetricReading{
+		SSLHandshakes:       100,
+		SSLHandshakesFailed: 5,
+		ServerZones: map[string]ZoneReading{
+			"api": {Requests: 100, Responses4xx: 10, Responses5xx: 1},
+		},
+		Caches: map[string]CacheReading{
+			"static": {Hits: 50, Misses: 5},
+		},
+	}
+	c.processPlusExtras(first)
+
+	// First poll only seeds the running totals - no rate yet, same as
+	// Accepted does for the stub_status path.
+	if c.state.SSLHandshakes != 0 {
+		t.Errorf("SSLHandshakes after first poll = %d, want 0", c.state.SSLHandshakes)
+	}
+
+	second := &MetricReading{
+		SSLHandshakes:       100 + 60*PollSeconds,
+		SSLHandshakesFailed: 5 + 2*PollSeconds,
+		ServerZones: map[string]ZoneReading{
+			"api": {Requests: 100 + 30*PollSeconds, Responses4xx: 10 + 2*PollSeconds, Responses5xx: 1},
+		},
+		Caches: map[string]CacheReading{
+			"static": {Hits: 50 + 10*PollSeconds, Misses: 5},
+		},
+	}
+	c.processPlusExtras(second)
+
+	if c.state.SSLHandshakes != 60 {
+		t.Errorf("SSLHandshakes = %d, want 60", c.state.SSLHandshakes)
+	}
+	if c.state.SSLHandshakesFailed != 2 {
+		t.Errorf("SSLHandshakesFailed = %d, want 2", c.state.SSLHandshakesFailed)
+	}
+
+	zone := c.state.Zones["api"]
+	if zone.Requests != 30 {
+		t.Errorf("zone Requests = %d, want 30", zone.Requests)
+	}
+	if zone.Responses4xx != 2 {
+		t.Errorf("zone Responses4xx = %d, want 2", zone.Responses4xx)
+	}
+	if zone.Responses5xx != 0 {
+		t.Errorf("zone Responses5xx = %d, want 0 (unchanged between polls)", zone.Responses5xx)
+	}
+
+	cache := c.state.Caches["static"]
+	if cache.Hits != 10 {
+		t.Errorf("cache Hits = %d, want 10", cache.Hits)
+	}
+	if cache.Misses != 0 {
+		t.Errorf("cache Misses = %d, want 0 (unchanged between polls)", cache.Misses)
+	}
+}
+
+func Test_PlusExtrasMetrics_UpstreamPeerState(t *testing.T) {
+	c := &NginxComponent{ComponentName: "test"}
+	c.processPlusExtras(&MetricReading{
+		Upstreams: map[string]UpstreamReading{
+			"backend": {Peers: map[string]string{
+				"10.0.0.1:80": "up",
+				"10.0.0.2:80": "down",
+				"10.0.0.3:80": "bogus",
+			}},
+		},
+	})
+
+	metrics := c.plusExtrasMetrics()
+
+	if got := metrics["Component/Upstreams/backend/10.0.0.1_80/State[State]"]; got != 0 {
+		t.Errorf("up peer state = %d, want 0", got)
+	}
+	if got := metrics["Component/Upstreams/backend/10.0.0.2_80/State[State]"]; got != 1 {
+		t.Errorf("down peer state = %d, want 1", got)
+	}
+	if got := metrics["Component/Upstreams/backend/10.0.0.3_80/State[State]"]; got != -1 {
+		t.Errorf("unknown peer state = %d, want -1", got)
+	}
+}
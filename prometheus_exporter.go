@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var metricNameSanitizer = regexp.MustCompile(`[^a-zA-Z0-9_]+`)
+
+// prometheusMetricName translates a `newrelic:"Component/..."` struct tag
+// into a snake_case Prometheus metric name, stripping the `[Unit/sec]`
+// suffix New Relic uses to label the unit.
+func prometheusMetricName(tag string) string {
+	if idx := strings.Index(tag, "["); idx != -1 {
+		tag = tag[:idx]
+	}
+
+	tag = metricNameSanitizer.ReplaceAllString(tag, "_")
+	return strings.ToLower(strings.Trim(tag, "_"))
+}
+
+// PrometheusExporter serves /metrics for every field of every component's
+// harvested NrMetric, so operators who aren't on New Relic can scrape the
+// same data with Prometheus instead.
+type PrometheusExporter struct {
+	ch     chan []Component
+	addr   string
+	gauges map[string]*prometheus.GaugeVec
+}
+
+func NewPrometheusExporter(addr string) *PrometheusExporter {
+	return &PrometheusExporter{
+		ch:     make(chan []Component),
+		addr:   addr,
+		gauges: make(map[string]*prometheus.GaugeVec),
+	}
+}
+
+func (e *PrometheusExporter) Name() string              { return "prometheus" }
+func (e *PrometheusExporter) Channel() chan []Component { return e.ch }
+
+func (e *PrometheusExporter) Run() {
+	go e.serve()
+
+	for components := range e.ch {
+		for _, c := range components {
+			nrComponent := c.Harvest()
+			for tag, value := range nrComponent.Metrics {
+				e.gaugeFor(tag).WithLabelValues(nrComponent.Name).Set(float64(value))
+			}
+		}
+	}
+}
+
+// gaugeFor returns the GaugeVec for a metric tag, registering it with the
+// default Prometheus registry the first time it's seen.
+func (e *PrometheusExporter) gaugeFor(tag string) *prometheus.GaugeVec {
+	name := prometheusMetricName(tag)
+
+	gauge, ok := e.gauges[name]
+	if !ok {
+		gauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: name,
+			Help: tag,
+		}, []string{"component"})
+		prometheus.MustRegister(gauge)
+		e.gauges[name] = gauge
+	}
+
+	return gauge
+}
+
+func (e *PrometheusExporter) serve() {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	log.Infof("Prometheus exporter listening on %s", e.addr)
+	if err := http.ListenAndServe(e.addr, mux); err != nil {
+		log.Errorf("Prometheus exporter failed: %s", err)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// DiskQueue is a small append-only-file backed queue for NrUpload batches
+// that couldn't be delivered. It exists so a New Relic outage of a few
+// minutes doesn't lose data: failed uploads get appended here and are
+// replayed the next time the agent starts, before it resumes live polling.
+type DiskQueue struct {
+	path string
+}
+
+func NewDiskQueue(dir string) *DiskQueue {
+	return &DiskQueue{path: filepath.Join(dir, "pending-uploads.jsonl")}
+}
+
+// Enqueue appends one upload to the queue file as a line of JSON.
+func (q *DiskQueue) Enqueue(upload *NrUpload) error {
+	f, err := os.OpenFile(q.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	line, err := json.Marshal(upload)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(append(line, '\n'))
+	return err
+}
+
+// Replay reads every queued upload and hands each to send, dropping
+// entries from the queue file as soon as they've gone out. That way a
+// failure partway through (item 3 of 5, say) leaves only the entries
+// that haven't been sent yet on disk, rather than retrying the whole
+// file on the next restart and redelivering ones that already went out.
+// Meant to run once at startup, before the poll loop begins producing
+// new uploads.
+func (q *DiskQueue) Replay(send func(*NrUpload) error) error {
+	f, err := os.Open(q.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var pending []*NrUpload
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var upload NrUpload
+		if err := json.Unmarshal(scanner.Bytes(), &upload); err != nil {
+			log.Errorf("Skipping corrupt queued upload: %s", err)
+			continue
+		}
+		pending = append(pending, &upload)
+	}
+	scanErr := scanner.Err()
+	f.Close()
+	if scanErr != nil {
+		return scanErr
+	}
+
+	log.Infof("Replaying %d queued uploads from %s", len(pending), q.path)
+	for i, upload := range pending {
+		if err := send(upload); err != nil {
+			if rewriteErr := q.rewrite(pending[i:]); rewriteErr != nil {
+				log.Errorf("Failed to persist remaining queued uploads after a replay error: %s", rewriteErr)
+			}
+			return err
+		}
+	}
+
+	return os.Remove(q.path)
+}
+
+// rewrite replaces the queue file's contents with exactly the given
+// uploads. Used by Replay to drop already-sent entries as soon as a
+// later one fails, instead of leaving the whole original file in place.
+func (q *DiskQueue) rewrite(uploads []*NrUpload) error {
+	f, err := os.OpenFile(q.path, os.O_TRUNC|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	for _, upload := range uploads {
+		line, err := json.Marshal(upload)
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(append(line, '\n')); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Depth reports how many uploads are currently waiting in the queue file.
+func (q *DiskQueue) Depth() (int64, error) {
+	f, err := os.Open(q.path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var depth int64
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		depth++
+	}
+
+	return depth, scanner.Err()
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_DiskQueue_EnqueueReplay(t *testing.T) {
+	dir := t.TempDir()
+	q := NewDiskQueue(dir)
+
+	upload1 := NewNrUpload([]*NrComponent{{Guid: "g", Name: "one"}})
+	upload2 := NewNrUpload([]*NrComponent{{Guid: "g", Name: "two"}})
+
+	if err := q.Enqueue(upload1); err != nil {
+		t.Fatalf("Enqueue: %s", err)
+	}
+	if err := q.Enqueue(upload2); err != nil {
+		t.Fatalf("Enqueue: %s", err)
+	}
+
+	depth, err := q.Depth()
+	if err != nil {
+		t.Fatalf("Depth: %s", err)
+	}
+	if depth != 2 {
+		t.Fatalf("Depth = %d, want 2", depth)
+	}
+
+	var replayed []string
+	err = q.Replay(func(u *NrUpload) error {
+		replayed = append(replayed, u.Components[0].Name)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Replay: %s", err)
+	}
+
+	if len(replayed) != 2 || replayed[0] != "one" || replayed[1] != "two" {
+		t.Fatalf("Replay order/content = %v, want [one two]", replayed)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "pending-uploads.jsonl")); !os.IsNotExist(err) {
+		t.Fatalf("queue file should be removed after a successful replay, stat err = %v", err)
+	}
+
+	depth, err = q.Depth()
+	if err != nil {
+		t.Fatalf("Depth after replay: %s", err)
+	}
+	if depth != 0 {
+		t.Fatalf("Depth after replay = %d, want 0", depth)
+	}
+}
+
+func Test_DiskQueue_ReplayLeavesFileOnFailure(t *testing.T) {
+	dir := t.TempDir()
+	q := NewDiskQueue(dir)
+
+	if err := q.Enqueue(NewNrUpload(nil)); err != nil {
+		t.Fatalf("Enqueue: %s", err)
+	}
+
+	wantErr := errors.New("still unreachable")
+	err := q.Replay(func(*NrUpload) error { return wantErr })
+	if err != wantErr {
+		t.Fatalf("Replay error = %v, want %v", err, wantErr)
+	}
+
+	depth, err := q.Depth()
+	if err != nil {
+		t.Fatalf("Depth: %s", err)
+	}
+	if depth != 1 {
+		t.Fatalf("Depth after failed replay = %d, want 1 (file should be left in place for the next restart to retry)", depth)
+	}
+}
+
+func Test_DiskQueue_ReplayDoesNotRedeliverSucceededItemsOnPartialFailure(t *testing.T) {
+	dir := t.TempDir()
+	q := NewDiskQueue(dir)
+
+	for _, name := range []string{"one", "two", "three"} {
+		upload := NewNrUpload([]*NrComponent{{Guid: "g", Name: name}})
+		if err := q.Enqueue(upload); err != nil {
+			t.Fatalf("Enqueue: %s", err)
+		}
+	}
+
+	var sent []string
+	wantErr := errors.New("still unreachable")
+	err := q.Replay(func(u *NrUpload) error {
+		name := u.Components[0].Name
+		if name == "two" {
+			return wantErr
+		}
+		sent = append(sent, name)
+		return nil
+	})
+	if err != wantErr {
+		t.Fatalf("Replay error = %v, want %v", err, wantErr)
+	}
+	if len(sent) != 1 || sent[0] != "one" {
+		t.Fatalf("sent before failure = %v, want [one]", sent)
+	}
+
+	// Retry with everything succeeding this time - "one" already went out
+	// above and must not come back.
+	var replayed []string
+	err = q.Replay(func(u *NrUpload) error {
+		replayed = append(replayed, u.Components[0].Name)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Replay (retry): %s", err)
+	}
+	if len(replayed) != 2 || replayed[0] != "two" || replayed[1] != "three" {
+		t.Fatalf(`Replay (retry) = %v, want [two three] ("one" already succeeded and must not be redelivered)`, replayed)
+	}
+}
+
+func Test_DiskQueue_DepthNoFile(t *testing.T) {
+	q := NewDiskQueue(t.TempDir())
+
+	depth, err := q.Depth()
+	if err != nil {
+		t.Fatalf("Depth: %s", err)
+	}
+	if depth != 0 {
+		t.Fatalf("Depth = %d, want 0 for a queue that's never been written to", depth)
+	}
+}
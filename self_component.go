@@ -0,0 +1,80 @@
+package main
+
+import "sync/atomic"
+
+// SelfComponentName is the component name the agent reports its own health
+// under, distinct from any nginx instance it's scraping.
+const SelfComponentName = "com.nginx.newrelic-agent.self"
+
+var (
+	fetchLatency     = newLatencyHistogram("nginx fetch")
+	uploadLatency    = newLatencyHistogram("New Relic upload")
+	uploadErrorCount int64
+)
+
+// SelfComponent reports the agent's own health as an additional New Relic
+// component, so a stale-looking dashboard can be traced back to nginx
+// being slow to respond, New Relic being slow or erroring, or the agent
+// itself falling behind on its retry queue.
+type SelfComponent struct {
+	duration int
+	state    SelfMetric
+}
+
+func NewSelfComponent() *SelfComponent {
+	return &SelfComponent{}
+}
+
+func (c *SelfComponent) Name() string            { return SelfComponentName }
+func (c *SelfComponent) Guid() string            { return AgentGuid }
+func (c *SelfComponent) SetDuration(seconds int) { c.duration = seconds }
+
+// SelfMetric is what gets reported for the self-health component each
+// poll: mean latencies since the last harvest, how often uploads have
+// been erroring, and how much work is backed up in the retry queue.
+type SelfMetric struct {
+	FetchDuration  int64 `newrelic:"Component/Agent/Fetch/Duration[ms]"`
+	UploadDuration int64 `newrelic:"Component/Agent/Upload/Duration[ms]"`
+	UploadErrors   int64 `newrelic:"Component/Agent/Upload/Errors[errors/min]"`
+	QueueDepth     int64 `newrelic:"Component/Agent/Queue/Depth[items]"`
+}
+
+// refresh folds the latency histograms and error counter accumulated
+// since the last poll into this component's state, resetting them for
+// the next interval. It must run exactly once per poll, before any
+// exporter's Harvest() sees this component - otherwise, with more than
+// one exporter enabled, whichever one harvests first would claim the
+// real numbers and the rest would see zeroes.
+func (c *SelfComponent) refresh() {
+	c.state = SelfMetric{
+		FetchDuration:  fetchLatency.HarvestMeanMs(),
+		UploadDuration: uploadLatency.HarvestMeanMs(),
+		UploadErrors:   atomic.SwapInt64(&uploadErrorCount, 0),
+		QueueDepth:     queueDepth(),
+	}
+}
+
+func (c *SelfComponent) Harvest() *NrComponent {
+	return &NrComponent{
+		Guid:     c.Guid(),
+		Duration: c.duration,
+		Name:     c.Name(),
+		Metrics:  marshalMetrics(c.state),
+	}
+}
+
+// queueDepth reports how many uploads are waiting in the on-disk retry
+// queue, or 0 if no queue is configured (AGENT_QUEUE_DIR unset) or none
+// has been created yet.
+func queueDepth() int64 {
+	if activeQueue == nil {
+		return 0
+	}
+
+	depth, err := activeQueue.Depth()
+	if err != nil {
+		return 0
+	}
+
+	return depth
+}
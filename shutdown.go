@@ -0,0 +1,45 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// abool is a tiny atomic boolean - enough for the poll loop to check for a
+// shutdown request without a mutex, the same pattern drone/woodpecker
+// agents use to guard their poll loops.
+type abool struct {
+	flag int32
+}
+
+func (a *abool) Set(value bool) {
+	var i int32
+	if value {
+		i = 1
+	}
+	atomic.StoreInt32(&a.flag, i)
+}
+
+func (a *abool) IsSet() bool {
+	return atomic.LoadInt32(&a.flag) == 1
+}
+
+// sigterm is set once a shutdown signal has been received, so the poll
+// loop can stop starting new component fetches mid-cycle.
+var sigterm abool
+
+// waitForShutdown blocks until SIGINT or SIGTERM, then sets sigterm and
+// closes quit so processStats can do one last flush and return.
+func waitForShutdown(quit chan struct{}) {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+
+	<-sigChan
+	log.Warn("Received shutdown signal, finishing up")
+	sigterm.Set(true)
+	close(quit)
+}